@@ -0,0 +1,102 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcapi exposes raftexample's KvStore over gRPC, alongside the
+// existing HTTP handler.
+package grpcapi
+
+// KeyValue mirrors etcd's mvccpb.KeyValue, trimmed to what KvStore tracks.
+type KeyValue struct {
+	Key      string
+	Value    string
+	Revision uint64
+}
+
+type PutRequest struct {
+	Key    string
+	Value  string
+	Lease  int64
+	PrevKv bool
+}
+
+type PutResponse struct {
+	PrevKv *KeyValue
+}
+
+// RangeRequest looks up Key, or every key in [Key, RangeEnd) when RangeEnd
+// is set, mirroring etcd's half-open range convention.
+type RangeRequest struct {
+	Key      string
+	RangeEnd string
+}
+
+type RangeResponse struct {
+	Kvs []*KeyValue
+}
+
+type DeleteRangeRequest struct {
+	Key      string
+	RangeEnd string
+	PrevKv   bool
+}
+
+type DeleteRangeResponse struct {
+	Deleted int64
+	PrevKvs []*KeyValue
+}
+
+// Compare is an equality check on a key's current value.
+type Compare struct {
+	Key   string
+	Value string
+}
+
+// PutOp and DeleteOp are the only request kinds a Txn branch may contain.
+type PutOp struct {
+	Key   string
+	Value string
+}
+
+type DeleteOp struct {
+	Key string
+}
+
+type RequestOp struct {
+	Put    *PutOp
+	Delete *DeleteOp
+}
+
+// TxnRequest applies Success atomically if every Compare holds, or Failure
+// otherwise.
+type TxnRequest struct {
+	Compare []Compare
+	Success []RequestOp
+	Failure []RequestOp
+}
+
+type TxnResponse struct {
+	Succeeded bool
+}
+
+type WatchRequest struct {
+	Prefix   string
+	Revision uint64
+}
+
+type WatchResponse struct {
+	Revision uint64
+	Key      string
+	Value    string
+	Op       string
+}
@@ -0,0 +1,293 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcapi
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"store"
+	"store/auth"
+)
+
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+}
+
+// Dial connects to a server started by ServeGrpcKVAPI. Use this instead of
+// grpc.Dial directly: it adds the default call option that selects
+// gobCodec, so callers don't have to pass grpc.CallContentSubtype("gob") on
+// every RPC themselves.
+func Dial(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(opts, grpc.WithDefaultCallOptions(grpc.CallContentSubtype(gobCodec{}.Name())))
+	return grpc.Dial(target, opts...)
+}
+
+// authUserKeyType is the context key the auth interceptors stash the
+// resolved user name under, for handlers to read via userFromContext.
+type authUserKeyType struct{}
+
+var authUserKey authUserKeyType
+
+// authenticate resolves the bearer token carried in ctx's incoming metadata
+// under the "authorization" key, mirroring the HTTP API's Authorization
+// header. A request with no token is treated as the anonymous user, which
+// is only permitted while auth is disabled.
+func authenticate(as *auth.AuthStore, ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("authorization")
+	if len(tokens) == 0 {
+		if as.Enabled() {
+			return "", status.Error(codes.Unauthenticated, "missing authorization token")
+		}
+		return "", nil
+	}
+	token := strings.TrimPrefix(tokens[0], "Bearer ")
+	user, err := as.AuthenticateToken(token)
+	if err != nil {
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+	return user, nil
+}
+
+// userFromContext returns the user name resolved by the auth interceptors.
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(authUserKey).(string)
+	return user
+}
+
+// checkPermitted reports a PermissionDenied error unless the user resolved
+// onto ctx has reqType access to key, the same check HttpKVAPI makes before
+// dispatching a request.
+func checkPermitted(ctx context.Context, kv *store.KvStore, key string, reqType auth.PermType) error {
+	if !kv.AuthStore().IsPermitted(userFromContext(ctx), key, reqType) {
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return nil
+}
+
+// unaryAuthInterceptor authenticates the caller and stashes the resolved
+// user name in ctx for the handler's own checkPermitted call.
+func unaryAuthInterceptor(kv *store.KvStore) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		user, err := authenticate(kv.AuthStore(), ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(context.WithValue(ctx, authUserKey, user), req)
+	}
+}
+
+// streamAuthInterceptor is the streaming-RPC counterpart of
+// unaryAuthInterceptor, used by Watch.
+func streamAuthInterceptor(kv *store.KvStore) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		user, err := authenticate(kv.AuthStore(), ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authServerStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), authUserKey, user)})
+	}
+}
+
+// authServerStream overrides ServerStream.Context so handlers see the
+// context streamAuthInterceptor populated with the resolved user.
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authServerStream) Context() context.Context { return s.ctx }
+
+// kvServer implements KVServer on top of the same store.KvStore the HTTP
+// handler uses.
+type kvServer struct {
+	store *store.KvStore
+}
+
+func (k *kvServer) Put(ctx context.Context, req *PutRequest) (*PutResponse, error) {
+	if err := checkPermitted(ctx, k.store, req.Key, auth.WRITE); err != nil {
+		return nil, err
+	}
+	var resp PutResponse
+	if req.PrevKv {
+		if v, ok := k.store.Lookup(req.Key); ok {
+			resp.PrevKv = &KeyValue{Key: req.Key, Value: v}
+		}
+	}
+	k.store.Propose(req.Key, req.Value, "SET")
+	if req.Lease != 0 {
+		if err := k.store.ProposeLeaseAttach(req.Lease, req.Key); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return &resp, nil
+}
+
+func (k *kvServer) Range(ctx context.Context, req *RangeRequest) (*RangeResponse, error) {
+	if err := checkPermitted(ctx, k.store, req.Key, auth.READ); err != nil {
+		return nil, err
+	}
+	matches := k.store.Range(req.Key, req.RangeEnd)
+	resp := &RangeResponse{Kvs: make([]*KeyValue, 0, len(matches))}
+	for key, val := range matches {
+		resp.Kvs = append(resp.Kvs, &KeyValue{Key: key, Value: val})
+	}
+	return resp, nil
+}
+
+func (k *kvServer) DeleteRange(ctx context.Context, req *DeleteRangeRequest) (*DeleteRangeResponse, error) {
+	if err := checkPermitted(ctx, k.store, req.Key, auth.WRITE); err != nil {
+		return nil, err
+	}
+	matches := k.store.Range(req.Key, req.RangeEnd)
+	resp := &DeleteRangeResponse{Deleted: int64(len(matches))}
+	for key, val := range matches {
+		if req.PrevKv {
+			resp.PrevKvs = append(resp.PrevKvs, &KeyValue{Key: key, Value: val})
+		}
+		k.store.Propose(key, "", "DEL")
+	}
+	return resp, nil
+}
+
+func (k *kvServer) Txn(ctx context.Context, req *TxnRequest) (*TxnResponse, error) {
+	for _, c := range req.Compare {
+		if err := checkPermitted(ctx, k.store, c.Key, auth.READ); err != nil {
+			return nil, err
+		}
+	}
+	for _, op := range req.Success {
+		if key, ok := requestOpKey(op); ok {
+			if err := checkPermitted(ctx, k.store, key, auth.WRITE); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, op := range req.Failure {
+		if key, ok := requestOpKey(op); ok {
+			if err := checkPermitted(ctx, k.store, key, auth.WRITE); err != nil {
+				return nil, err
+			}
+		}
+	}
+	txn := store.TxnOp{
+		Compare: toStoreCompares(req.Compare),
+		Success: toStoreOps(req.Success),
+		Failure: toStoreOps(req.Failure),
+	}
+	succeeded, err := k.store.ProposeTxnAndWait(txn)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &TxnResponse{Succeeded: succeeded}, nil
+}
+
+// requestOpKey extracts the key a RequestOp touches, if any.
+func requestOpKey(op RequestOp) (string, bool) {
+	switch {
+	case op.Put != nil:
+		return op.Put.Key, true
+	case op.Delete != nil:
+		return op.Delete.Key, true
+	default:
+		return "", false
+	}
+}
+
+func toStoreCompares(cmps []Compare) []store.Compare {
+	out := make([]store.Compare, len(cmps))
+	for i, c := range cmps {
+		out[i] = store.Compare{Key: c.Key, Value: c.Value}
+	}
+	return out
+}
+
+func toStoreOps(ops []RequestOp) []store.RequestOp {
+	out := make([]store.RequestOp, len(ops))
+	for i, op := range ops {
+		switch {
+		case op.Put != nil:
+			out[i] = store.RequestOp{Put: &store.PutOp{Key: op.Put.Key, Value: op.Put.Value}}
+		case op.Delete != nil:
+			out[i] = store.RequestOp{Delete: &store.DeleteOp{Key: op.Delete.Key}}
+		}
+	}
+	return out
+}
+
+// watchServer implements WatchServer on top of store.KvStore's watcher
+// registry, the same one the HTTP WATCH endpoint streams from.
+type watchServer struct {
+	store *store.KvStore
+}
+
+func (w *watchServer) Watch(req *WatchRequest, stream Watch_WatchServer) error {
+	if err := checkPermitted(stream.Context(), w.store, req.Prefix, auth.READ); err != nil {
+		return err
+	}
+	events, cancel := w.store.Watch(req.Prefix, req.Revision)
+	defer cancel()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(&WatchResponse{Revision: ev.Revision, Key: ev.Key, Value: ev.Val, Op: ev.Op}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// ServeGrpcKVAPI starts a gRPC server over the same store.KvStore instance
+// ServeHttpKVAPI serves, so both can run in the same binary.
+func ServeGrpcKVAPI(kv *store.KvStore, port int, confChangeC chan<- raftpb.ConfChange, errorC <-chan error) {
+	lis, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(unaryAuthInterceptor(kv)),
+		grpc.StreamInterceptor(streamAuthInterceptor(kv)),
+	)
+	RegisterKVServer(srv, &kvServer{store: kv})
+	RegisterWatchServer(srv, &watchServer{store: kv})
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// exit when raftd goes down
+	if err, ok := <-errorC; ok {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcapi
+
+import (
+	"reflect"
+	"testing"
+
+	"store"
+)
+
+func TestToStoreCompares(t *testing.T) {
+	got := toStoreCompares([]Compare{{Key: "foo", Value: "bar"}, {Key: "baz", Value: "qux"}})
+	want := []store.Compare{{Key: "foo", Value: "bar"}, {Key: "baz", Value: "qux"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("toStoreCompares = %+v, want %+v", got, want)
+	}
+}
+
+func TestToStoreOps(t *testing.T) {
+	got := toStoreOps([]RequestOp{
+		{Put: &PutOp{Key: "foo", Value: "bar"}},
+		{Delete: &DeleteOp{Key: "baz"}},
+	})
+	want := []store.RequestOp{
+		{Put: &store.PutOp{Key: "foo", Value: "bar"}},
+		{Delete: &store.DeleteOp{Key: "baz"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("toStoreOps = %+v, want %+v", got, want)
+	}
+}
+
+func TestRequestOpKey(t *testing.T) {
+	if key, ok := requestOpKey(RequestOp{Put: &PutOp{Key: "foo"}}); !ok || key != "foo" {
+		t.Fatalf("requestOpKey(Put) = %q, %v, want %q, true", key, ok, "foo")
+	}
+	if key, ok := requestOpKey(RequestOp{Delete: &DeleteOp{Key: "bar"}}); !ok || key != "bar" {
+		t.Fatalf("requestOpKey(Delete) = %q, %v, want %q, true", key, ok, "bar")
+	}
+	if _, ok := requestOpKey(RequestOp{}); ok {
+		t.Fatal("requestOpKey(empty) = true, want false")
+	}
+}
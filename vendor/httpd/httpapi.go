@@ -15,13 +15,16 @@
 package httpd
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/coreos/etcd/raft/raftpb"
 	"store"
+	"store/auth"
 )
 
 // Handler for a http based key-value store backed by raftd
@@ -31,7 +34,46 @@ type HttpKVAPI struct {
 }
 
 func (h *HttpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	key := r.RequestURI
+	if strings.HasPrefix(r.RequestURI, "/auth/") {
+		h.serveAuth(w, r)
+		return
+	}
+	if r.Method == "WATCH" {
+		h.serveWatch(w, r)
+		return
+	}
+	if strings.HasPrefix(r.RequestURI, "/lease/") {
+		h.serveLease(w, r)
+		return
+	}
+	if r.URL.Path == "/members" {
+		h.serveMembersList(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/members/") {
+		h.serveMember(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/kv/") {
+		http.Error(w, "Not found; keys live under /kv/<key>, members under /members/<id>", http.StatusNotFound)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/kv")
+	reqType := auth.READ
+	if r.Method != "GET" {
+		reqType = auth.WRITE
+	}
+	user, ok := h.authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.store.AuthStore().IsPermitted(user, key, reqType) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	switch {
 	case r.Method == "PUT":
 		v, err := ioutil.ReadAll(r.Body)
@@ -41,64 +83,431 @@ func (h *HttpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.store.Propose(key, string(v),"SET")
+		if err := h.store.ProposeAndWait(key, string(v), "SET"); err != nil {
+			h.writeProposeError(w, err)
+			return
+		}
 
-		// Optimistic-- no waiting for ack from raftd. Value is not yet
-		// committed so a subsequent GET on the key may return old value
+		if leaseParam := r.URL.Query().Get("lease"); leaseParam != "" {
+			leaseID, err := strconv.ParseInt(leaseParam, 10, 64)
+			if err != nil {
+				http.Error(w, "Bad lease id", http.StatusBadRequest)
+				return
+			}
+			if err := h.store.ProposeLeaseAttach(leaseID, key); err != nil {
+				http.Error(w, "Failed to attach lease", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Synchronous-- by the time this returns, the write has committed
+		// and a subsequent GET on the key is guaranteed to see it.
 		w.WriteHeader(http.StatusNoContent)
 	case r.Method == "GET":
+		if r.URL.Query().Get("consistency") == "linearizable" {
+			v, ok, err := h.store.LinearizableLookup(key)
+			if err != nil {
+				h.writeProposeError(w, err)
+				return
+			}
+			if !ok {
+				http.Error(w, "Failed to GET", http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(v))
+			return
+		}
+		// consistency=serializable (the default): fast local read that may
+		// not reflect the most recently committed write.
 		if v, ok := h.store.Lookup(key); ok {
 			w.Write([]byte(v))
 		} else {
 			http.Error(w, "Failed to GET", http.StatusNotFound)
 		}
-	case r.Method == "POST":
-		url, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("Failed to read on POST (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
+	case r.Method == "DELETE":
+		if err := h.store.ProposeAndWait(key, "", "DEL"); err != nil {
+			h.writeProposeError(w, err)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT")
+		w.Header().Add("Allow", "GET")
+		w.Header().Add("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authenticate resolves the bearer token on r, if any, to a user name. A
+// request with no Authorization header is treated as the anonymous user,
+// which is only permitted while auth is disabled.
+func (h *HttpKVAPI) authenticate(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", !h.store.AuthStore().Enabled()
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	user, err := h.store.AuthStore().AuthenticateToken(token)
+	if err != nil {
+		return "", false
+	}
+	return user, true
+}
+
+// serveAuth handles the /auth/* namespace: authentication and the admin
+// endpoints used to manage users, roles and permissions.
+func (h *HttpKVAPI) serveAuth(w http.ResponseWriter, r *http.Request) {
+	switch r.RequestURI {
+	case "/auth/authenticate":
+		h.authAuthenticate(w, r)
+	case "/auth/user-add":
+		h.authUserAdd(w, r)
+	case "/auth/role-add":
+		h.authRoleAdd(w, r)
+	case "/auth/role-grant-permission":
+		h.authRoleGrantPermission(w, r)
+	case "/auth/user-grant-role":
+		h.authUserGrantRole(w, r)
+	case "/auth/enable":
+		h.authEnable(w, r)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+type authenticateRequest struct {
+	Name     string
+	Password string
+}
+
+func (h *HttpKVAPI) authAuthenticate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req authenticateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	token, err := h.store.AuthStore().Authenticate(req.Name, req.Password)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct{ Token string }{token})
+}
+
+type userAddRequest struct {
+	Name     string
+	Password string
+}
+
+func (h *HttpKVAPI) authUserAdd(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req userAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	err = h.store.ProposeAuth(auth.Mutation{
+		Action:  "UserAdd",
+		UserAdd: &auth.UserAddMutation{Name: req.Name, PasswordHash: hash},
+	})
+	h.reply(w, err)
+}
 
-		nodeId, err := strconv.ParseUint(key[1:], 0, 64)
+type roleAddRequest struct {
+	Name string
+}
+
+func (h *HttpKVAPI) authRoleAdd(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req roleAddRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	err := h.store.ProposeAuth(auth.Mutation{
+		Action:  "RoleAdd",
+		RoleAdd: &auth.RoleAddMutation{Name: req.Name},
+	})
+	h.reply(w, err)
+}
+
+type roleGrantPermissionRequest struct {
+	Role     string
+	PermType auth.PermType
+	Key      string
+	RangeEnd string
+}
+
+func (h *HttpKVAPI) authRoleGrantPermission(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req roleGrantPermissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	err := h.store.ProposeAuth(auth.Mutation{
+		Action: "GrantPermission",
+		Grant: &auth.GrantPermissionMutation{
+			Role: req.Role,
+			Permission: auth.Permission{
+				PermType: req.PermType,
+				Key:      req.Key,
+				RangeEnd: req.RangeEnd,
+			},
+		},
+	})
+	h.reply(w, err)
+}
+
+type userGrantRoleRequest struct {
+	User string
+	Role string
+}
+
+func (h *HttpKVAPI) authUserGrantRole(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	var req userGrantRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	err := h.store.ProposeAuth(auth.Mutation{
+		Action: "GrantRole",
+		Role:   &auth.GrantRoleMutation{User: req.User, Role: req.Role},
+	})
+	h.reply(w, err)
+}
+
+func (h *HttpKVAPI) authEnable(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	err := h.store.ProposeAuth(auth.Mutation{Action: "AuthEnable"})
+	h.reply(w, err)
+}
+
+// requireAdmin authenticates the request and, once auth is enabled, requires
+// that one of the caller's roles grants READWRITE on the key "". Holding the
+// root role does not by itself pass this check; the role must carry that
+// permission. While disabled, any caller may bootstrap the store (add a
+// user, create the root role, grant it) and then call /auth/enable, which
+// itself refuses to enable auth until that root user/role pair exists.
+func (h *HttpKVAPI) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, ok := h.authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !h.store.AuthStore().Enabled() {
+		return true
+	}
+	if !h.store.AuthStore().IsPermitted(user, "", auth.READWRITE) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *HttpKVAPI) reply(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeProposeError maps a ProposeAndWait/LinearizableLookup error to the
+// appropriate HTTP status: unavailable while leaderless, gateway timeout if
+// raft never committed in time, otherwise a generic server error.
+func (h *HttpKVAPI) writeProposeError(w http.ResponseWriter, err error) {
+	switch err {
+	case store.ErrNotLeader:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case store.ErrTimedOut:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveWatch handles WATCH /key?prefix=...&revision=... by upgrading the
+// connection to a chunked stream of newline-delimited JSON events, one per
+// committed mutation under the given prefix.
+func (h *HttpKVAPI) serveWatch(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Path
+	if p := r.URL.Query().Get("prefix"); p != "" {
+		prefix = p
+	}
+
+	user, ok := h.authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.store.AuthStore().IsPermitted(user, prefix, auth.READ) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var startRevision uint64
+	if rev := r.URL.Query().Get("revision"); rev != "" {
+		v, err := strconv.ParseUint(rev, 10, 64)
 		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
+		startRevision = v
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := h.store.Watch(prefix, startRevision)
+	defer cancel()
 
-		cc := raftpb.ConfChange{
-			Type:    raftpb.ConfChangeAddNode,
-			NodeID:  nodeId,
-			Context: url,
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
 		}
-		h.confChangeC <- cc
+	}
+}
 
-		// As above, optimistic that raftd will apply the conf change
-		w.WriteHeader(http.StatusNoContent)
+// serveLease handles the /lease/* namespace: grant, keepalive and revoke.
+func (h *HttpKVAPI) serveLease(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.store.AuthStore().IsPermitted(user, r.URL.Path, auth.WRITE) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && r.RequestURI == "/lease/grant":
+		var req struct{ TTL int64 }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		id, err := h.store.ProposeLeaseGrant(req.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			ID  int64
+			TTL int64
+		}{id, req.TTL})
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/lease/keepalive/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/lease/keepalive/"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad lease id", http.StatusBadRequest)
+			return
+		}
+		h.reply(w, h.store.ProposeLeaseKeepAlive(id))
 	case r.Method == "DELETE":
-		/*nodeId, err := strconv.ParseUint(key[1:], 0, 64)
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/lease/"), 10, 64)
 		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on DELETE", http.StatusBadRequest)
+			http.Error(w, "Bad lease id", http.StatusBadRequest)
 			return
 		}
+		h.reply(w, h.store.ProposeLeaseRevoke(id))
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
 
-		cc := raftpb.ConfChange{
-			Type:   raftpb.ConfChangeRemoveNode,
-			NodeID: nodeId,
-		}
-		h.confChangeC <- cc
+// serveMembersList handles GET /members, returning the current cluster
+// membership -- as last updated by applied conf changes -- as JSON.
+func (h *HttpKVAPI) serveMembersList(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.store.Membership().Members())
+}
 
-		// As above, optimistic that raftd will apply the conf change
-		w.WriteHeader(http.StatusNoContent)*/
+// serveMember handles the /members/<id> namespace: POST to add a member
+// (voting by default, or a learner with ?type=learner), PUT to change a
+// member's URL, and DELETE to remove it.
+func (h *HttpKVAPI) serveMember(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
 
-		h.store.Propose(key, "","DEL")
+	nodeId, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/members/"), 0, 64)
+	if err != nil {
+		http.Error(w, "Bad member id", http.StatusBadRequest)
+		return
+	}
 
+	switch r.Method {
+	case "POST":
+		url, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			return
+		}
+		ccType := raftpb.ConfChangeAddNode
+		if r.URL.Query().Get("type") == "learner" {
+			ccType = raftpb.ConfChangeAddLearnerNode
+		}
+		h.confChangeC <- raftpb.ConfChange{Type: ccType, NodeID: nodeId, Context: url}
+		w.WriteHeader(http.StatusNoContent)
+	case "PUT":
+		url, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed on PUT", http.StatusBadRequest)
+			return
+		}
+		h.confChangeC <- raftpb.ConfChange{Type: raftpb.ConfChangeUpdateNode, NodeID: nodeId, Context: url}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		h.confChangeC <- raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: nodeId}
+		w.WriteHeader(http.StatusNoContent)
 	default:
-		w.Header().Set("Allow", "PUT")
-		w.Header().Add("Allow", "GET")
-		w.Header().Add("Allow", "POST")
+		w.Header().Set("Allow", "POST")
+		w.Header().Add("Allow", "PUT")
 		w.Header().Add("Allow", "DELETE")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -0,0 +1,393 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth implements a Raft-replicated user/role/permission store.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserNotFound     = errors.New("auth: user not found")
+	ErrUserAlreadyExist = errors.New("auth: user already exists")
+	ErrRoleNotFound     = errors.New("auth: role not found")
+	ErrRoleAlreadyExist = errors.New("auth: role already exists")
+	ErrInvalidPassword  = errors.New("auth: invalid password")
+	ErrPermissionDenied = errors.New("auth: permission denied")
+	ErrInvalidToken     = errors.New("auth: invalid token")
+	ErrAuthNotEnabled   = errors.New("auth: not enabled")
+	ErrRootRoleNotFound = errors.New("auth: root role does not exist")
+	ErrRootUserNotFound = errors.New("auth: no user is granted the root role")
+)
+
+// RootRole is the role AuthEnable requires to exist and to be granted to at
+// least one user before it enables auth. Its name alone grants nothing:
+// access comes from the permissions granted to it.
+const RootRole = "root"
+
+// PermType is the kind of access a Permission grants.
+type PermType int
+
+const (
+	READ PermType = iota
+	WRITE
+	READWRITE
+)
+
+// Permission grants access to a single key or a [Key, RangeEnd) range.
+// An empty RangeEnd means the permission only covers Key itself.
+type Permission struct {
+	PermType PermType
+	Key      string
+	RangeEnd string
+}
+
+// covers reports whether the permission allows reqType access to key.
+func (p Permission) covers(key string, reqType PermType) bool {
+	if p.PermType != READWRITE && p.PermType != reqType {
+		return false
+	}
+	if p.RangeEnd == "" {
+		return key == p.Key
+	}
+	return key >= p.Key && key < p.RangeEnd
+}
+
+// Role is a named collection of permissions.
+type Role struct {
+	Name        string
+	Permissions []Permission
+}
+
+// User is an account that can authenticate and is granted zero or more roles.
+type User struct {
+	Name         string
+	PasswordHash []byte
+	Roles        []string
+}
+
+// Mutation is the Raft-replicated representation of a single auth change.
+// Exactly one payload field is set, selected by Action; AuthEnable has none.
+type Mutation struct {
+	Action string // "UserAdd", "RoleAdd", "GrantPermission", "GrantRole", "AuthEnable"
+
+	UserAdd *UserAddMutation
+	RoleAdd *RoleAddMutation
+	Grant   *GrantPermissionMutation
+	Role    *GrantRoleMutation
+}
+
+type UserAddMutation struct {
+	Name         string
+	PasswordHash []byte
+}
+
+type RoleAddMutation struct {
+	Name string
+}
+
+type GrantPermissionMutation struct {
+	Role       string
+	Permission Permission
+}
+
+type GrantRoleMutation struct {
+	User string
+	Role string
+}
+
+// Snapshot is the persisted form of an AuthStore, suitable for embedding in
+// the store package's own snapshot.
+type Snapshot struct {
+	Enabled bool
+	Users   map[string]*User
+	Roles   map[string]*Role
+}
+
+// AuthStore holds users, roles and permissions. Mutations arrive through
+// Apply once agreed on via Raft; reads may happen locally at any time.
+type AuthStore struct {
+	mu      sync.RWMutex
+	enabled bool
+	users   map[string]*User
+	roles   map[string]*Role
+
+	simpleTokensMu sync.RWMutex
+	simpleTokens   map[string]string // token -> user name
+
+	signKey *rsa.PrivateKey
+}
+
+// NewAuthStore creates an empty AuthStore, signing tokens with the RSA key
+// at jwtKeyFile if given, otherwise falling back to opaque simple tokens.
+func NewAuthStore(jwtKeyFile string) (*AuthStore, error) {
+	s := &AuthStore{
+		users:        make(map[string]*User),
+		roles:        make(map[string]*Role),
+		simpleTokens: make(map[string]string),
+	}
+	if jwtKeyFile != "" {
+		key, err := loadRSAKey(jwtKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.signKey = key
+	}
+	return s, nil
+}
+
+func loadRSAKey(path string) (*rsa.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("auth: %s does not contain a PEM block", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("auth: %s is not an RSA private key", path)
+	}
+	return rsaKey, nil
+}
+
+// Enabled reports whether authentication is required for incoming requests.
+func (s *AuthStore) Enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled
+}
+
+// Apply replays a committed Mutation into the in-memory store. It is called
+// from KvStore.readCommits once a mutation has been agreed on via Raft.
+func (s *AuthStore) Apply(m Mutation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Action {
+	case "UserAdd":
+		u := m.UserAdd
+		if _, ok := s.users[u.Name]; ok {
+			return ErrUserAlreadyExist
+		}
+		s.users[u.Name] = &User{Name: u.Name, PasswordHash: u.PasswordHash}
+	case "RoleAdd":
+		r := m.RoleAdd
+		if _, ok := s.roles[r.Name]; ok {
+			return ErrRoleAlreadyExist
+		}
+		s.roles[r.Name] = &Role{Name: r.Name}
+	case "GrantPermission":
+		g := m.Grant
+		role, ok := s.roles[g.Role]
+		if !ok {
+			return ErrRoleNotFound
+		}
+		role.Permissions = append(role.Permissions, g.Permission)
+	case "GrantRole":
+		g := m.Role
+		user, ok := s.users[g.User]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if _, ok := s.roles[g.Role]; !ok {
+			return ErrRoleNotFound
+		}
+		user.Roles = append(user.Roles, g.Role)
+	case "AuthEnable":
+		if _, ok := s.roles[RootRole]; !ok {
+			return ErrRootRoleNotFound
+		}
+		if !s.hasRootUserLocked() {
+			return ErrRootUserNotFound
+		}
+		s.enabled = true
+	default:
+		return fmt.Errorf("auth: unknown mutation action %q", m.Action)
+	}
+	return nil
+}
+
+// hasRootUserLocked reports whether some user has been granted RootRole.
+// Callers must hold s.mu.
+func (s *AuthStore) hasRootUserLocked() bool {
+	for _, u := range s.users {
+		for _, r := range u.Roles {
+			if r == RootRole {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticate verifies name/password and issues a bearer token: a signed JWT
+// when a signing key is configured, otherwise an opaque simple token.
+func (s *AuthStore) Authenticate(name, password string) (string, error) {
+	s.mu.RLock()
+	user, ok := s.users[name]
+	s.mu.RUnlock()
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	if bcryptCompare(user.PasswordHash, password) != nil {
+		return "", ErrInvalidPassword
+	}
+	if s.signKey != nil {
+		return s.issueJWT(name)
+	}
+	return s.issueSimpleToken(name)
+}
+
+func bcryptCompare(hash []byte, password string) error {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// HashPassword hashes a plaintext password for storage in a User.
+func HashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func (s *AuthStore) issueJWT(name string) (string, error) {
+	claims := jwt.MapClaims{
+		"username": name,
+		"revision": time.Now().Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	return token.SignedString(s.signKey)
+}
+
+func (s *AuthStore) issueSimpleToken(name string) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	tok := base64.RawURLEncoding.EncodeToString(raw)
+	s.simpleTokensMu.Lock()
+	s.simpleTokens[tok] = name
+	s.simpleTokensMu.Unlock()
+	return tok, nil
+}
+
+// AuthenticateToken resolves a bearer token to the user name that holds it.
+func (s *AuthStore) AuthenticateToken(token string) (string, error) {
+	if s.signKey != nil {
+		parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, ErrInvalidToken
+			}
+			return &s.signKey.PublicKey, nil
+		})
+		if err == nil && parsed.Valid {
+			claims := parsed.Claims.(jwt.MapClaims)
+			if name, ok := claims["username"].(string); ok {
+				return name, nil
+			}
+		}
+	}
+	s.simpleTokensMu.RLock()
+	name, ok := s.simpleTokens[token]
+	s.simpleTokensMu.RUnlock()
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	return name, nil
+}
+
+// IsPermitted reports whether user is granted reqType access to key through
+// any of its roles. When auth is disabled every request is permitted.
+func (s *AuthStore) IsPermitted(name, key string, reqType PermType) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.enabled {
+		return true
+	}
+	user, ok := s.users[name]
+	if !ok {
+		return false
+	}
+	for _, roleName := range user.Roles {
+		role, ok := s.roles[roleName]
+		if !ok {
+			continue
+		}
+		for _, p := range role.Permissions {
+			if p.covers(key, reqType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Snapshot returns a deep-enough copy of the store for persistence.
+func (s *AuthStore) Snapshot() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := &Snapshot{
+		Enabled: s.enabled,
+		Users:   make(map[string]*User, len(s.users)),
+		Roles:   make(map[string]*Role, len(s.roles)),
+	}
+	for k, v := range s.users {
+		u := *v
+		snap.Users[k] = &u
+	}
+	for k, v := range s.roles {
+		r := *v
+		snap.Roles[k] = &r
+	}
+	return snap
+}
+
+// Restore replaces the store's contents with a previously taken Snapshot.
+func (s *AuthStore) Restore(snap *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if snap == nil {
+		s.enabled = false
+		s.users = make(map[string]*User)
+		s.roles = make(map[string]*Role)
+		return
+	}
+	s.enabled = snap.Enabled
+	s.users = snap.Users
+	s.roles = snap.Roles
+	if s.users == nil {
+		s.users = make(map[string]*User)
+	}
+	if s.roles == nil {
+		s.roles = make(map[string]*Role)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import "testing"
+
+// TestUserAddDoesNotEnable guards against the bootstrap deadlock where
+// adding the first user alone used to flip enabled to true, locking every
+// caller out of the still-role-less admin endpoints.
+func TestUserAddDoesNotEnable(t *testing.T) {
+	s, err := NewAuthStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Mutation{Action: "UserAdd", UserAdd: &UserAddMutation{Name: "root"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled() {
+		t.Fatal("AuthStore became enabled after UserAdd alone")
+	}
+}
+
+// TestAuthEnableRequiresRootRoleGrant exercises the full bootstrap sequence
+// and the two ways it can be attempted too early.
+func TestAuthEnableRequiresRootRoleGrant(t *testing.T) {
+	s, err := NewAuthStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Apply(Mutation{Action: "AuthEnable"}); err != ErrRootRoleNotFound {
+		t.Fatalf("AuthEnable with no root role = %v, want ErrRootRoleNotFound", err)
+	}
+
+	if err := s.Apply(Mutation{Action: "UserAdd", UserAdd: &UserAddMutation{Name: "root"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Mutation{Action: "RoleAdd", RoleAdd: &RoleAddMutation{Name: RootRole}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Mutation{Action: "AuthEnable"}); err != ErrRootUserNotFound {
+		t.Fatalf("AuthEnable with no user granted root = %v, want ErrRootUserNotFound", err)
+	}
+
+	if err := s.Apply(Mutation{Action: "GrantPermission", Grant: &GrantPermissionMutation{
+		Role:       RootRole,
+		Permission: Permission{PermType: READWRITE, Key: ""},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Mutation{Action: "GrantRole", Role: &GrantRoleMutation{User: "root", Role: RootRole}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(Mutation{Action: "AuthEnable"}); err != nil {
+		t.Fatalf("AuthEnable after granting root role: %v", err)
+	}
+	if !s.Enabled() {
+		t.Fatal("AuthStore not enabled after a valid AuthEnable")
+	}
+	if !s.IsPermitted("root", "", READWRITE) {
+		t.Fatal("root user not permitted on the admin gate's own (\"\", READWRITE) check")
+	}
+}
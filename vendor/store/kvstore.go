@@ -18,11 +18,30 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/snap"
 	"fmt"
+
+	"store/auth"
+	"store/lease"
+)
+
+var (
+	// ErrTimedOut is returned by ProposeAndWait/ReadIndex when the
+	// configured timeout elapses before the proposal commits.
+	ErrTimedOut = errors.New("store: proposal timed out")
+	// ErrNotLeader is returned by ProposeAndWait when this node stops being
+	// raft leader while a proposal is still outstanding.
+	ErrNotLeader = errors.New("store: lost leadership before proposal committed")
+	// ErrReadIndexUnsupported is returned by ReadIndex when the store was
+	// constructed without a requestReadIndex hook.
+	ErrReadIndexUnsupported = errors.New("store: linearizable reads not configured")
 )
 
 // a key-value store backed by raftd
@@ -31,23 +50,173 @@ type KvStore struct {
 	mu          sync.RWMutex
 	kvStore     map[string]string // current committed key-value pairs
 	snapshotter *snap.Snapshotter
+	authStore   *auth.AuthStore
+	leaseStore  *lease.LeaseStore
+	membership  *MembershipStore
+	isLeader    func() bool
+
+	revision  uint64 // monotonically increasing, bumped once per committed key put or delete
+	watchers  map[*watcher]struct{}
+	watchRing []Event // recent events, newest last, capped at watchRingSize
+
+	proposeTimeout time.Duration
+	proposalSeq    uint64
+	proposeWaiters map[uint64]chan error
+	txnWaiters     map[uint64]chan bool
+
+	appliedIndex       uint64 // the raft layer's real applied index, fed by appliedIndexC
+	readIndexSupported bool   // true once both requestReadIndex and appliedIndexC are wired up
+	readStateC         <-chan ReadState
+	requestReadIndex   func(id uint64) error
+	readIndexSeq       uint64
+	readIndexWaiters   map[uint64]chan uint64
 }
 
 type kv struct {
-	Key string
-	Val string
-	Opt string
+	Key        string
+	Val        string
+	Opt        string
+	ProposalID uint64 // non-zero when proposed via ProposeAndWait
+}
+
+// ReadState carries the result of a raft.Node.ReadIndex round trip back to
+// the KvStore that requested it: Index is the committed log index that must
+// be locally applied before the read it guards is linearizable.
+type ReadState struct {
+	ID    uint64
+	Index uint64
 }
 
-func NewKVStore(snapshotter *snap.Snapshotter, proposeC chan<- string, commitC <-chan *string, errorC <-chan error) *KvStore {
-	s := &KvStore{proposeC: proposeC, kvStore: make(map[string]string), snapshotter: snapshotter}
+// defaultProposeTimeout bounds how long ProposeAndWait and ReadIndex block
+// waiting for raft to commit. It can be overridden with SetProposeTimeout.
+const defaultProposeTimeout = 5 * time.Second
+
+// leaderPollInterval is how often ProposeAndWait checks isLeader while a
+// proposal is outstanding, so it can fail fast on a leadership change
+// instead of waiting out the full timeout.
+const leaderPollInterval = 100 * time.Millisecond
+
+// snapshotData is the persisted shape of a KvStore snapshot. It replaces the
+// bare map[string]string snapshot so that auth state survives restarts too.
+type snapshotData struct {
+	Kv         map[string]string
+	Auth       *auth.Snapshot
+	Lease      *lease.Snapshot
+	Membership *MembershipSnapshot
+}
+
+// leaseScanInterval is how often the leader checks for expired leases.
+const leaseScanInterval = time.Second
+
+// NewKVStore starts a KvStore. isLeader is polled by the background lease
+// scanner so only the current raft leader proposes LREVOKE for expired
+// leases; followers apply the resulting op like any other committed entry.
+//
+// requestReadIndex and readStateC back linearizable reads: requestReadIndex
+// should kick off a raft.Node.ReadIndex(ctx, token) call on the raft layer
+// for the given request id, and readStateC is where the resulting ReadState
+// is delivered once raft confirms it. appliedIndexC must deliver the raft
+// layer's real applied index (from raft.Ready.CommittedEntries, not a count
+// of entries KvStore happened to see on commitC -- those skip no-op and
+// conf-change entries, so the two are not the same number space). All three
+// may be nil, in which case ?consistency=linearizable GETs fail with
+// ErrReadIndexUnsupported.
+//
+// confChangeAppliedC delivers each raftpb.ConfChange once the raft layer has
+// actually applied it, so membership reflects the committed cluster state
+// rather than the optimistic POST/PUT/DELETE that requested the change.
+func NewKVStore(snapshotter *snap.Snapshotter, proposeC chan<- string, commitC <-chan *string, errorC <-chan error, jwtKeyFile string, isLeader func() bool, requestReadIndex func(id uint64) error, readStateC <-chan ReadState, confChangeAppliedC <-chan raftpb.ConfChange, appliedIndexC <-chan uint64) *KvStore {
+	authStore, err := auth.NewAuthStore(jwtKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &KvStore{
+		proposeC:           proposeC,
+		kvStore:            make(map[string]string),
+		snapshotter:        snapshotter,
+		authStore:          authStore,
+		leaseStore:         lease.NewLeaseStore(),
+		membership:         NewMembershipStore(),
+		isLeader:           isLeader,
+		watchers:           make(map[*watcher]struct{}),
+		proposeTimeout:     defaultProposeTimeout,
+		proposeWaiters:     make(map[uint64]chan error),
+		txnWaiters:         make(map[uint64]chan bool),
+		requestReadIndex:   requestReadIndex,
+		readIndexSupported: requestReadIndex != nil && appliedIndexC != nil,
+		readStateC:         readStateC,
+		readIndexWaiters:   make(map[uint64]chan uint64),
+	}
 	// replay log into key-value map
 	s.readCommits(commitC, errorC)
 	// read commits from raftd into kvStore map until error
 	go s.readCommits(commitC, errorC)
+	go s.runLeaseScanner(isLeader)
+	if readStateC != nil {
+		go s.readStateLoop()
+	}
+	if confChangeAppliedC != nil {
+		go s.applyConfChanges(confChangeAppliedC)
+	}
+	if appliedIndexC != nil {
+		go s.applyIndexLoop(appliedIndexC)
+	}
 	return s
 }
 
+// Membership returns the replicated cluster membership store so the HTTP
+// layer can list members and the applied-conf-change loop can update it.
+func (s *KvStore) Membership() *MembershipStore {
+	return s.membership
+}
+
+// applyConfChanges keeps membership in sync with every conf change the raft
+// layer applies, for as long as the cluster runs.
+func (s *KvStore) applyConfChanges(confChangeAppliedC <-chan raftpb.ConfChange) {
+	for cc := range confChangeAppliedC {
+		s.membership.Apply(cc)
+	}
+}
+
+// applyIndexLoop keeps appliedIndex in step with the raft layer's real
+// applied index, so waitApplied compares against the same number space
+// ReadIndex's results come from.
+func (s *KvStore) applyIndexLoop(appliedIndexC <-chan uint64) {
+	for index := range appliedIndexC {
+		s.mu.Lock()
+		if index > s.appliedIndex {
+			s.appliedIndex = index
+		}
+		s.mu.Unlock()
+	}
+}
+
+// SetProposeTimeout overrides how long ProposeAndWait and ReadIndex wait for
+// raft before giving up. The default is defaultProposeTimeout.
+func (s *KvStore) SetProposeTimeout(d time.Duration) {
+	s.mu.Lock()
+	s.proposeTimeout = d
+	s.mu.Unlock()
+}
+
+func (s *KvStore) proposeTimeoutDuration() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.proposeTimeout
+}
+
+// AuthStore returns the replicated user/role/permission store so the HTTP
+// layer can authenticate requests and check permissions.
+func (s *KvStore) AuthStore() *auth.AuthStore {
+	return s.authStore
+}
+
+// LeaseStore returns the replicated lease store so the HTTP layer can grant,
+// renew and revoke leases.
+func (s *KvStore) LeaseStore() *lease.LeaseStore {
+	return s.leaseStore
+}
+
 func (s *KvStore) Lookup(key string) (string, bool) {
 	s.mu.RLock()
 	v, ok := s.kvStore[key]
@@ -57,7 +226,7 @@ func (s *KvStore) Lookup(key string) (string, bool) {
 
 func (s *KvStore) Propose(k string, v string, op string) {
 	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(kv{k, v,op}); err != nil {
+	if err := gob.NewEncoder(&buf).Encode(kv{Key: k, Val: v, Opt: op}); err != nil {
 		log.Fatal(err)
 	}
 
@@ -65,6 +234,222 @@ func (s *KvStore) Propose(k string, v string, op string) {
 	s.proposeC <- string(buf.Bytes())
 }
 
+// ProposeAndWait proposes k/v/op and blocks until readCommits has applied
+// it, returning any error readCommits recorded for it. Unlike Propose, the
+// caller only observes success once the write is actually committed -- it
+// replaces the "optimistic" 204-before-commit pattern the HTTP PUT handler
+// used to rely on.
+func (s *KvStore) ProposeAndWait(k string, v string, op string) error {
+	id := atomic.AddUint64(&s.proposalSeq, 1)
+	ch := make(chan error, 1)
+	s.mu.Lock()
+	s.proposeWaiters[id] = ch
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(kv{Key: k, Val: v, Opt: op, ProposalID: id}); err != nil {
+		log.Fatal(err)
+	}
+	s.proposeC <- buf.String()
+
+	timeout := time.NewTimer(s.proposeTimeoutDuration())
+	defer timeout.Stop()
+	leaderCheck := time.NewTicker(leaderPollInterval)
+	defer leaderCheck.Stop()
+
+	for {
+		select {
+		case err := <-ch:
+			return err
+		case <-timeout.C:
+			s.cancelProposeWaiter(id)
+			return ErrTimedOut
+		case <-leaderCheck.C:
+			if s.isLeader != nil && !s.isLeader() {
+				s.cancelProposeWaiter(id)
+				return ErrNotLeader
+			}
+		}
+	}
+}
+
+func (s *KvStore) cancelProposeWaiter(id uint64) {
+	s.mu.Lock()
+	delete(s.proposeWaiters, id)
+	s.mu.Unlock()
+}
+
+// signalProposeWaiter notifies any ProposeAndWait caller for id, if one is
+// still outstanding. Called from readCommits once an entry is applied.
+func (s *KvStore) signalProposeWaiter(id uint64, err error) {
+	if id == 0 {
+		return
+	}
+	s.mu.Lock()
+	ch, ok := s.proposeWaiters[id]
+	if ok {
+		delete(s.proposeWaiters, id)
+	}
+	s.mu.Unlock()
+	if ok {
+		ch <- err
+	}
+}
+
+// ProposeTxnAndWait replicates txn through Raft as a single "TXN" op and
+// blocks until readCommits has applied it, returning the branch that was
+// actually committed.
+func (s *KvStore) ProposeTxnAndWait(txn TxnOp) (bool, error) {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return false, err
+	}
+
+	id := atomic.AddUint64(&s.proposalSeq, 1)
+	ch := make(chan bool, 1)
+	s.mu.Lock()
+	s.txnWaiters[id] = ch
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(kv{Val: string(data), Opt: "TXN", ProposalID: id}); err != nil {
+		log.Fatal(err)
+	}
+	s.proposeC <- buf.String()
+
+	timeout := time.NewTimer(s.proposeTimeoutDuration())
+	defer timeout.Stop()
+	leaderCheck := time.NewTicker(leaderPollInterval)
+	defer leaderCheck.Stop()
+
+	for {
+		select {
+		case succeeded := <-ch:
+			return succeeded, nil
+		case <-timeout.C:
+			s.cancelTxnWaiter(id)
+			return false, ErrTimedOut
+		case <-leaderCheck.C:
+			if s.isLeader != nil && !s.isLeader() {
+				s.cancelTxnWaiter(id)
+				return false, ErrNotLeader
+			}
+		}
+	}
+}
+
+func (s *KvStore) cancelTxnWaiter(id uint64) {
+	s.mu.Lock()
+	delete(s.txnWaiters, id)
+	s.mu.Unlock()
+}
+
+// signalTxnWaiter notifies any ProposeTxnAndWait caller for id with the
+// branch that was actually applied. Called from readCommits while still
+// holding s.mu, same as the TXN apply itself.
+func (s *KvStore) signalTxnWaiter(id uint64, succeeded bool) {
+	if id == 0 {
+		return
+	}
+	ch, ok := s.txnWaiters[id]
+	if ok {
+		delete(s.txnWaiters, id)
+	}
+	if ok {
+		ch <- succeeded
+	}
+}
+
+// ProposeAuth replicates an auth mutation (user/role/permission change)
+// through Raft as an "AUTH" op.
+func (s *KvStore) ProposeAuth(m auth.Mutation) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.Propose("", string(data), "AUTH")
+	return nil
+}
+
+type leaseGrantPayload struct {
+	ID  int64
+	TTL int64
+}
+
+type leaseKeepAlivePayload struct {
+	ID int64
+}
+
+type leaseAttachPayload struct {
+	ID  int64
+	Key string
+}
+
+// ProposeLeaseGrant replicates a new lease of the given TTL (in seconds)
+// through Raft as an "LGRANT" op. The ID is generated by the caller so it is
+// available immediately, optimistic about the grant committing.
+func (s *KvStore) ProposeLeaseGrant(ttl int64) (int64, error) {
+	id := lease.NewID()
+	data, err := json.Marshal(leaseGrantPayload{ID: id, TTL: ttl})
+	if err != nil {
+		return 0, err
+	}
+	s.Propose("", string(data), "LGRANT")
+	return id, nil
+}
+
+// ProposeLeaseKeepAlive replicates a lease renewal through Raft as an "LKA" op.
+func (s *KvStore) ProposeLeaseKeepAlive(id int64) error {
+	data, err := json.Marshal(leaseKeepAlivePayload{ID: id})
+	if err != nil {
+		return err
+	}
+	s.Propose("", string(data), "LKA")
+	return nil
+}
+
+// ProposeLeaseAttach replicates attaching key to lease id through Raft as an
+// "LATTACH" op; the key is deleted when the lease is revoked or expires.
+func (s *KvStore) ProposeLeaseAttach(id int64, key string) error {
+	data, err := json.Marshal(leaseAttachPayload{ID: id, Key: key})
+	if err != nil {
+		return err
+	}
+	s.Propose("", string(data), "LATTACH")
+	return nil
+}
+
+// ProposeLeaseRevoke replicates revoking a lease through Raft as an "LREVOKE"
+// op. It is used both by the HTTP DELETE /lease/<id> handler and by the
+// leader's background lease scanner for expired leases.
+func (s *KvStore) ProposeLeaseRevoke(id int64) error {
+	data, err := json.Marshal(leaseKeepAlivePayload{ID: id})
+	if err != nil {
+		return err
+	}
+	s.Propose("", string(data), "LREVOKE")
+	return nil
+}
+
+// runLeaseScanner periodically proposes LREVOKE for any lease the leader
+// observes as expired. Followers never propose revocations themselves; they
+// simply apply whatever LREVOKE the leader replicates, so expiry is
+// deterministic across the cluster.
+func (s *KvStore) runLeaseScanner(isLeader func() bool) {
+	ticker := time.NewTicker(leaseScanInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if isLeader != nil && !isLeader() {
+			continue
+		}
+		for _, id := range s.leaseStore.Expired() {
+			if err := s.ProposeLeaseRevoke(id); err != nil {
+				log.Printf("raftexample: could not propose revoke for expired lease %d (%v)", id, err)
+			}
+		}
+	}
+}
+
 func (s *KvStore) readCommits(commitC <-chan *string, errorC <-chan error) {
 
 	for data := range commitC {
@@ -96,32 +481,100 @@ func (s *KvStore) readCommits(commitC <-chan *string, errorC <-chan error) {
 		switch dataKv.Opt {
 		case "SET" :
 			s.kvStore[dataKv.Key] = dataKv.Val
+			s.revision++
+			s.publish(Event{Revision: s.revision, Key: dataKv.Key, Val: dataKv.Val, Op: dataKv.Opt})
 		case "DEL" :
 			delete(s.kvStore,dataKv.Key)
+			s.revision++
+			s.publish(Event{Revision: s.revision, Key: dataKv.Key, Val: dataKv.Val, Op: dataKv.Opt})
+		case "AUTH":
+			var m auth.Mutation
+			if err := json.Unmarshal([]byte(dataKv.Val), &m); err != nil {
+				log.Printf("raftexample: could not decode auth mutation (%v)", err)
+				break
+			}
+			if err := s.authStore.Apply(m); err != nil {
+				log.Printf("raftexample: could not apply auth mutation (%v)", err)
+			}
+		case "LGRANT":
+			var p leaseGrantPayload
+			if err := json.Unmarshal([]byte(dataKv.Val), &p); err != nil {
+				log.Printf("raftexample: could not decode lease grant (%v)", err)
+				break
+			}
+			s.leaseStore.Grant(p.ID, p.TTL)
+		case "LKA":
+			var p leaseKeepAlivePayload
+			if err := json.Unmarshal([]byte(dataKv.Val), &p); err != nil {
+				log.Printf("raftexample: could not decode lease keepalive (%v)", err)
+				break
+			}
+			if err := s.leaseStore.KeepAlive(p.ID); err != nil {
+				log.Printf("raftexample: could not renew lease %d (%v)", p.ID, err)
+			}
+		case "LATTACH":
+			var p leaseAttachPayload
+			if err := json.Unmarshal([]byte(dataKv.Val), &p); err != nil {
+				log.Printf("raftexample: could not decode lease attach (%v)", err)
+				break
+			}
+			if err := s.leaseStore.Attach(p.ID, p.Key); err != nil {
+				log.Printf("raftexample: could not attach key %q to lease %d (%v)", p.Key, p.ID, err)
+			}
+		case "LREVOKE":
+			var p leaseKeepAlivePayload
+			if err := json.Unmarshal([]byte(dataKv.Val), &p); err != nil {
+				log.Printf("raftexample: could not decode lease revoke (%v)", err)
+				break
+			}
+			for _, key := range s.leaseStore.Revoke(p.ID) {
+				delete(s.kvStore, key)
+				s.revision++
+				s.publish(Event{Revision: s.revision, Key: key, Op: "DEL"})
+			}
+		case "TXN":
+			var txn TxnOp
+			if err := json.Unmarshal([]byte(dataKv.Val), &txn); err != nil {
+				log.Printf("raftexample: could not decode txn (%v)", err)
+				break
+			}
+			succeeded := s.txnSucceeds(txn)
+			if succeeded {
+				s.applyTxnOps(txn.Success)
+			} else {
+				s.applyTxnOps(txn.Failure)
+			}
+			s.signalTxnWaiter(dataKv.ProposalID, succeeded)
 		default:
 			//do nothing
 		}
 
 		s.mu.Unlock()
+		s.signalProposeWaiter(dataKv.ProposalID, nil)
 	}
 	if err, ok := <-errorC; ok {
+		s.closeWatchers()
 		log.Fatal(err)
 	}
 }
 
 func (s *KvStore) GetSnapshot() ([]byte, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	return json.Marshal(s.kvStore)
+	data := snapshotData{Kv: s.kvStore, Auth: s.authStore.Snapshot(), Lease: s.leaseStore.Snapshot(), Membership: s.membership.Snapshot()}
+	s.mu.Unlock()
+	return json.Marshal(data)
 }
 
 func (s *KvStore) recoverFromSnapshot(snapshot []byte) error {
-	var store map[string]string
-	if err := json.Unmarshal(snapshot, &store); err != nil {
+	var data snapshotData
+	if err := json.Unmarshal(snapshot, &data); err != nil {
 		return err
 	}
 	s.mu.Lock()
-	s.kvStore = store
+	s.kvStore = data.Kv
 	s.mu.Unlock()
+	s.authStore.Restore(data.Auth)
+	s.leaseStore.Restore(data.Lease)
+	s.membership.Restore(data.Membership)
 	return nil
 }
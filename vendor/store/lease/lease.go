@@ -0,0 +1,170 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lease implements TTL-based lease tracking for raftexample.
+package lease
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrLeaseNotFound = errors.New("lease: not found")
+
+// Lease is a single TTL grant that zero or more keys may be attached to.
+type Lease struct {
+	ID       int64
+	TTL      int64 // seconds
+	ExpireAt time.Time
+}
+
+// Snapshot is the persisted form of a LeaseStore.
+type Snapshot struct {
+	Leases map[int64]*Lease
+	Keys   map[int64][]string // lease ID -> attached keys
+}
+
+// LeaseStore tracks leases and the keys attached to them. Mutating methods
+// are meant to be called from KvStore.readCommits after a lease op commits.
+type LeaseStore struct {
+	mu     sync.Mutex
+	leases map[int64]*Lease
+	keys   map[int64]map[string]struct{}
+}
+
+func NewLeaseStore() *LeaseStore {
+	return &LeaseStore{
+		leases: make(map[int64]*Lease),
+		keys:   make(map[int64]map[string]struct{}),
+	}
+}
+
+// NewID generates a lease ID at random so concurrent grants on different
+// replicas don't collide before the LGRANT op they issue is replicated.
+func NewID() int64 {
+	var b [8]byte
+	rand.Read(b[:])
+	id := int64(binary.BigEndian.Uint64(b[:]) & 0x7fffffffffffffff)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+// Grant applies a committed LGRANT: it records a lease with the given id and
+// ttl, expiring ttl seconds from now.
+func (s *LeaseStore) Grant(id, ttl int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases[id] = &Lease{ID: id, TTL: ttl, ExpireAt: time.Now().Add(time.Duration(ttl) * time.Second)}
+	if _, ok := s.keys[id]; !ok {
+		s.keys[id] = make(map[string]struct{})
+	}
+}
+
+// KeepAlive applies a committed LKA: it pushes the lease's expiry out by its
+// TTL, as of now.
+func (s *LeaseStore) KeepAlive(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	l.ExpireAt = time.Now().Add(time.Duration(l.TTL) * time.Second)
+	return nil
+}
+
+// Attach applies a committed LATTACH: it records that key should be deleted
+// when the lease is revoked.
+func (s *LeaseStore) Attach(id int64, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.leases[id]; !ok {
+		return ErrLeaseNotFound
+	}
+	s.keys[id][key] = struct{}{}
+	return nil
+}
+
+// Revoke applies a committed LREVOKE: it forgets the lease and returns the
+// keys that were attached to it, so the caller can delete them from kvStore.
+func (s *LeaseStore) Revoke(id int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.keys[id]))
+	for k := range s.keys[id] {
+		keys = append(keys, k)
+	}
+	delete(s.keys, id)
+	delete(s.leases, id)
+	return keys
+}
+
+// Expired returns the IDs of every lease whose expiry has passed, for the
+// background scanner to propose an LREVOKE for each.
+func (s *LeaseStore) Expired() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var ids []int64
+	for id, l := range s.leases {
+		if now.After(l.ExpireAt) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (s *LeaseStore) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &Snapshot{
+		Leases: make(map[int64]*Lease, len(s.leases)),
+		Keys:   make(map[int64][]string, len(s.keys)),
+	}
+	for id, l := range s.leases {
+		cp := *l
+		snap.Leases[id] = &cp
+	}
+	for id, ks := range s.keys {
+		for k := range ks {
+			snap.Keys[id] = append(snap.Keys[id], k)
+		}
+	}
+	return snap
+}
+
+func (s *LeaseStore) Restore(snap *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases = make(map[int64]*Lease)
+	s.keys = make(map[int64]map[string]struct{})
+	if snap == nil {
+		return
+	}
+	for id, l := range snap.Leases {
+		s.leases[id] = l
+	}
+	for id, ks := range snap.Keys {
+		set := make(map[string]struct{}, len(ks))
+		for _, k := range ks {
+			set[k] = struct{}{}
+		}
+		s.keys[id] = set
+	}
+}
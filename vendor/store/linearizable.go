@@ -0,0 +1,102 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// appliedIndexPollInterval is how often waitApplied re-checks appliedIndex
+// while a linearizable read is blocked on it.
+const appliedIndexPollInterval = 5 * time.Millisecond
+
+// readStateLoop delivers each ReadState raft reports back to whichever
+// ReadIndex call is waiting on its ID.
+func (s *KvStore) readStateLoop() {
+	for rs := range s.readStateC {
+		s.mu.Lock()
+		ch, ok := s.readIndexWaiters[rs.ID]
+		if ok {
+			delete(s.readIndexWaiters, rs.ID)
+		}
+		s.mu.Unlock()
+		if ok {
+			ch <- rs.Index
+		}
+	}
+}
+
+// ReadIndex asks the raft layer to confirm this node is still leader and
+// returns the committed log index a read must wait for to be linearizable.
+func (s *KvStore) ReadIndex() (uint64, error) {
+	if !s.readIndexSupported {
+		return 0, ErrReadIndexUnsupported
+	}
+
+	id := atomic.AddUint64(&s.readIndexSeq, 1)
+	ch := make(chan uint64, 1)
+	s.mu.Lock()
+	s.readIndexWaiters[id] = ch
+	s.mu.Unlock()
+
+	if err := s.requestReadIndex(id); err != nil {
+		s.mu.Lock()
+		delete(s.readIndexWaiters, id)
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	select {
+	case index := <-ch:
+		return index, nil
+	case <-time.After(s.proposeTimeoutDuration()):
+		s.mu.Lock()
+		delete(s.readIndexWaiters, id)
+		s.mu.Unlock()
+		return 0, ErrTimedOut
+	}
+}
+
+// waitApplied blocks until appliedIndex has caught up to index.
+func (s *KvStore) waitApplied(index uint64) error {
+	deadline := time.Now().Add(s.proposeTimeoutDuration())
+	for {
+		s.mu.RLock()
+		applied := s.appliedIndex
+		s.mu.RUnlock()
+		if applied >= index {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTimedOut
+		}
+		time.Sleep(appliedIndexPollInterval)
+	}
+}
+
+// LinearizableLookup performs a GET guaranteed to reflect every write
+// committed before the call started.
+func (s *KvStore) LinearizableLookup(key string) (string, bool, error) {
+	index, err := s.ReadIndex()
+	if err != nil {
+		return "", false, err
+	}
+	if err := s.waitApplied(index); err != nil {
+		return "", false, err
+	}
+	v, ok := s.Lookup(key)
+	return v, ok, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWaitAppliedUsesAppliedIndexLoopFeed guards against waitApplied
+// comparing against a locally-incremented commit counter instead of the
+// real raft applied index: appliedIndexC, not commitC traffic, must be what
+// advances it.
+func TestWaitAppliedUsesAppliedIndexLoopFeed(t *testing.T) {
+	s := &KvStore{proposeTimeout: 200 * time.Millisecond}
+
+	appliedIndexC := make(chan uint64)
+	go s.applyIndexLoop(appliedIndexC)
+
+	done := make(chan error, 1)
+	go func() { done <- s.waitApplied(100) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("waitApplied(100) returned %v before index 100 was ever fed", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	appliedIndexC <- 100
+	if err := <-done; err != nil {
+		t.Fatalf("waitApplied(100) after feeding index 100: %v", err)
+	}
+}
+
+// TestReadIndexRequiresAppliedIndexFeed guards against ReadIndex succeeding
+// (and waitApplied spinning to ErrTimedOut on every call) when the raft
+// layer only wired up requestReadIndex but not the appliedIndexC feed
+// waitApplied needs to make sense of the result.
+func TestReadIndexRequiresAppliedIndexFeed(t *testing.T) {
+	s := &KvStore{
+		proposeTimeout:     10 * time.Millisecond,
+		requestReadIndex:   func(id uint64) error { return nil },
+		readIndexSupported: false,
+		readIndexWaiters:   make(map[uint64]chan uint64),
+	}
+	if _, err := s.ReadIndex(); err != ErrReadIndexUnsupported {
+		t.Fatalf("ReadIndex with requestReadIndex but no appliedIndexC = %v, want ErrReadIndexUnsupported", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+// Member is a single entry in the cluster's membership list, as last
+// reflected by an applied raftpb.ConfChange.
+type Member struct {
+	ID      uint64
+	URL     string
+	Learner bool
+}
+
+// MembershipSnapshot is the persisted form of a MembershipStore.
+type MembershipSnapshot struct {
+	Members map[uint64]*Member
+}
+
+// MembershipStore tracks cluster membership as conf changes are applied.
+type MembershipStore struct {
+	mu      sync.RWMutex
+	members map[uint64]*Member
+}
+
+func NewMembershipStore() *MembershipStore {
+	return &MembershipStore{members: make(map[uint64]*Member)}
+}
+
+// Apply updates membership for a single conf change that raft has applied.
+func (m *MembershipStore) Apply(cc raftpb.ConfChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode:
+		m.members[cc.NodeID] = &Member{ID: cc.NodeID, URL: string(cc.Context)}
+	case raftpb.ConfChangeAddLearnerNode:
+		m.members[cc.NodeID] = &Member{ID: cc.NodeID, URL: string(cc.Context), Learner: true}
+	case raftpb.ConfChangeUpdateNode:
+		if member, ok := m.members[cc.NodeID]; ok {
+			member.URL = string(cc.Context)
+		}
+	case raftpb.ConfChangeRemoveNode:
+		delete(m.members, cc.NodeID)
+	}
+}
+
+// Members returns the current membership list, ordered by ID.
+func (m *MembershipStore) Members() []*Member {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]*Member, 0, len(m.members))
+	for _, member := range m.members {
+		cp := *member
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (m *MembershipStore) Snapshot() *MembershipSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snap := &MembershipSnapshot{Members: make(map[uint64]*Member, len(m.members))}
+	for id, member := range m.members {
+		cp := *member
+		snap.Members[id] = &cp
+	}
+	return snap
+}
+
+func (m *MembershipStore) Restore(snap *MembershipSnapshot) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.members = make(map[uint64]*Member)
+	if snap == nil {
+		return
+	}
+	for id, member := range snap.Members {
+		m.members[id] = member
+	}
+}
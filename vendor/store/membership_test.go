@@ -0,0 +1,87 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coreos/etcd/raft/raftpb"
+)
+
+func TestMembershipStoreApply(t *testing.T) {
+	m := NewMembershipStore()
+
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 1, Context: []byte("http://n1")})
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 2, Context: []byte("http://n2")})
+	want := []*Member{
+		{ID: 1, URL: "http://n1"},
+		{ID: 2, URL: "http://n2", Learner: true},
+	}
+	if got := m.Members(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Members() after adds = %+v, want %+v", got, want)
+	}
+
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeUpdateNode, NodeID: 1, Context: []byte("http://n1-new")})
+	if got, want := m.Members()[0].URL, "http://n1-new"; got != want {
+		t.Fatalf("URL after update = %q, want %q", got, want)
+	}
+
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 1})
+	want = []*Member{{ID: 2, URL: "http://n2", Learner: true}}
+	if got := m.Members(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Members() after remove = %+v, want %+v", got, want)
+	}
+}
+
+func TestMembershipStoreUpdateUnknownNodeIsNoop(t *testing.T) {
+	m := NewMembershipStore()
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeUpdateNode, NodeID: 7, Context: []byte("http://n7")})
+	if members := m.Members(); len(members) != 0 {
+		t.Fatalf("Members() = %+v, want empty (update of unknown node must not add it)", members)
+	}
+}
+
+func TestMembershipStoreSnapshotRestore(t *testing.T) {
+	m := NewMembershipStore()
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 1, Context: []byte("http://n1")})
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 2, Context: []byte("http://n2")})
+	snap := m.Snapshot()
+
+	restored := NewMembershipStore()
+	restored.Restore(snap)
+	if got, want := restored.Members(), m.Members(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Members() after restore = %+v, want %+v", got, want)
+	}
+
+	// Mutating the restored store must not reach back into the snapshot
+	// or the store it was taken from.
+	restored.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 1})
+	if got, want := len(restored.Members()), 1; got != want {
+		t.Fatalf("len(restored.Members()) after remove = %d, want %d", got, want)
+	}
+	if got, want := len(m.Members()), 2; got != want {
+		t.Fatalf("len(m.Members()) after mutating restored copy = %d, want %d (snapshot must be independent)", got, want)
+	}
+}
+
+func TestMembershipStoreRestoreNil(t *testing.T) {
+	m := NewMembershipStore()
+	m.Apply(raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 1, Context: []byte("http://n1")})
+	m.Restore(nil)
+	if members := m.Members(); len(members) != 0 {
+		t.Fatalf("Members() after Restore(nil) = %+v, want empty", members)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+// Compare is an equality check on a key's current value.
+type Compare struct {
+	Key   string
+	Value string
+}
+
+// PutOp and DeleteOp are the only operations a Txn branch may contain.
+type PutOp struct {
+	Key   string
+	Value string
+}
+
+type DeleteOp struct {
+	Key string
+}
+
+type RequestOp struct {
+	Put    *PutOp
+	Delete *DeleteOp
+}
+
+// TxnOp is the Raft-replicated payload of a "TXN" op: Success runs if every
+// Compare holds against the state at apply time, Failure otherwise.
+type TxnOp struct {
+	Compare []Compare
+	Success []RequestOp
+	Failure []RequestOp
+}
+
+// txnSucceeds reports whether every compare in txn holds against the store's
+// current state. Callers hold s.mu already.
+func (s *KvStore) txnSucceeds(txn TxnOp) bool {
+	for _, c := range txn.Compare {
+		if s.kvStore[c.Key] != c.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// applyTxnOps runs a Txn branch's operations against kvStore, bumping the
+// revision and publishing a watch event for each one. Callers hold s.mu.
+func (s *KvStore) applyTxnOps(ops []RequestOp) {
+	for _, op := range ops {
+		switch {
+		case op.Put != nil:
+			s.kvStore[op.Put.Key] = op.Put.Value
+			s.revision++
+			s.publish(Event{Revision: s.revision, Key: op.Put.Key, Val: op.Put.Value, Op: "SET"})
+		case op.Delete != nil:
+			delete(s.kvStore, op.Delete.Key)
+			s.revision++
+			s.publish(Event{Revision: s.revision, Key: op.Delete.Key, Op: "DEL"})
+		}
+	}
+}
+
+// Range returns every key in [key, rangeEnd), or just key itself when
+// rangeEnd is empty.
+func (s *KvStore) Range(key, rangeEnd string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if rangeEnd == "" {
+		if v, ok := s.kvStore[key]; ok {
+			return map[string]string{key: v}
+		}
+		return nil
+	}
+	result := make(map[string]string)
+	for k, v := range s.kvStore {
+		if k >= key && k < rangeEnd {
+			result[k] = v
+		}
+	}
+	return result
+}
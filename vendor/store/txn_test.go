@@ -0,0 +1,83 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/snap"
+)
+
+// newTestKVStore wires a KvStore to an in-process loop that immediately
+// echoes everything proposed back as committed, standing in for raft.
+func newTestKVStore(t *testing.T) *KvStore {
+	proposeC := make(chan string)
+	commitC := make(chan *string)
+	errorC := make(chan error)
+
+	go func() {
+		commitC <- nil // "replay done" so NewKVStore's initial sync readCommits returns
+		for data := range proposeC {
+			d := data
+			commitC <- &d
+		}
+	}()
+
+	s := NewKVStore(snap.New(t.TempDir()), proposeC, commitC, errorC, "", func() bool { return true }, nil, nil, nil, nil)
+	t.Cleanup(func() { close(errorC) })
+	return s
+}
+
+// TestProposeTxnAndWaitReflectsCommittedOutcome guards against TxnResponse
+// carrying a stale pre-check: Succeeded must match whichever branch
+// readCommits actually applied, not a preview taken before the proposal
+// went through Raft.
+func TestProposeTxnAndWaitReflectsCommittedOutcome(t *testing.T) {
+	s := newTestKVStore(t)
+
+	if err := s.ProposeAndWait("foo", "bar", "SET"); err != nil {
+		t.Fatalf("seed ProposeAndWait: %v", err)
+	}
+
+	succeeded, err := s.ProposeTxnAndWait(TxnOp{
+		Compare: []Compare{{Key: "foo", Value: "bar"}},
+		Success: []RequestOp{{Put: &PutOp{Key: "txn-result", Value: "success"}}},
+		Failure: []RequestOp{{Put: &PutOp{Key: "txn-result", Value: "failure"}}},
+	})
+	if err != nil {
+		t.Fatalf("ProposeTxnAndWait: %v", err)
+	}
+	if !succeeded {
+		t.Fatal("Succeeded = false, want true (compare holds)")
+	}
+	if v, _ := s.Lookup("txn-result"); v != "success" {
+		t.Fatalf("txn-result = %q, want %q (Succeeded disagrees with applied branch)", v, "success")
+	}
+
+	succeeded, err = s.ProposeTxnAndWait(TxnOp{
+		Compare: []Compare{{Key: "foo", Value: "not-bar"}},
+		Success: []RequestOp{{Put: &PutOp{Key: "txn-result", Value: "success"}}},
+		Failure: []RequestOp{{Put: &PutOp{Key: "txn-result", Value: "failure"}}},
+	})
+	if err != nil {
+		t.Fatalf("ProposeTxnAndWait: %v", err)
+	}
+	if succeeded {
+		t.Fatal("Succeeded = true, want false (compare does not hold)")
+	}
+	if v, _ := s.Lookup("txn-result"); v != "failure" {
+		t.Fatalf("txn-result = %q, want %q (Succeeded disagrees with applied branch)", v, "failure")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"log"
+	"strings"
+)
+
+// watchRingSize bounds how many recent events are kept so a newly registered
+// watcher can catch up without having observed every past mutation.
+const watchRingSize = 1024
+
+// Event is a single committed key mutation delivered to watchers.
+type Event struct {
+	Revision uint64
+	Key      string
+	Val      string
+	Op       string
+}
+
+// watcher is a single registered subscription. Events matching Prefix are
+// pushed to Ch; Ch is closed when the watcher is cancelled or errorC fires.
+type watcher struct {
+	Prefix string
+	Ch     chan Event
+}
+
+// Watch subscribes to committed mutations under prefix from startRevision
+// onward. The returned cancel function must be called once the caller is
+// done with the watcher.
+func (s *KvStore) Watch(prefix string, startRevision uint64) (<-chan Event, func()) {
+	ch := make(chan Event, 128)
+	w := &watcher{Prefix: prefix, Ch: ch}
+
+	s.mu.Lock()
+	// Deliver the replay and register the watcher in the same critical
+	// section publish uses, so a concurrent publish can't slip a live event
+	// into ch ahead of older ring events still being replayed. The send is
+	// non-blocking, same as publish's fan-out, so a slow or absent consumer
+	// can't wedge every other store operation behind ch's buffer.
+	for _, ev := range s.watchRing {
+		if ev.Revision >= startRevision && strings.HasPrefix(ev.Key, prefix) {
+			select {
+			case ch <- ev:
+			default:
+				log.Printf("raftexample: watcher for prefix %q is slow, dropping replayed event at revision %d", w.Prefix, ev.Revision)
+			}
+		}
+	}
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	cancel := func() {
+		s.mu.Lock()
+		if _, ok := s.watchers[w]; ok {
+			delete(s.watchers, w)
+			close(ch)
+		}
+		s.mu.Unlock()
+	}
+	return ch, cancel
+}
+
+// publish fans out a committed event to every watcher whose prefix matches.
+// Callers must hold s.mu.
+func (s *KvStore) publish(ev Event) {
+	s.watchRing = append(s.watchRing, ev)
+	if len(s.watchRing) > watchRingSize {
+		s.watchRing = s.watchRing[len(s.watchRing)-watchRingSize:]
+	}
+	for w := range s.watchers {
+		if !strings.HasPrefix(ev.Key, w.Prefix) {
+			continue
+		}
+		select {
+		case w.Ch <- ev:
+		default:
+			log.Printf("raftexample: watcher for prefix %q is slow, dropping event at revision %d", w.Prefix, ev.Revision)
+		}
+	}
+}
+
+// closeWatchers shuts down every registered watcher. Called once readCommits
+// observes errorC firing so clients don't block forever on a dead stream.
+func (s *KvStore) closeWatchers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.watchers {
+		delete(s.watchers, w)
+		close(w.Ch)
+	}
+}
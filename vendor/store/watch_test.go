@@ -0,0 +1,98 @@
+// Copyright 2015 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestWatchReplayDoesNotDeadlock guards against Watch wedging the whole
+// store: it seeds more matching events than the subscriber channel can hold
+// and never drains that channel, the way serveWatch's HTTP handler only
+// starts reading after Watch returns. Before the fix this blocked forever
+// inside s.mu.Lock(), so Lookup would hang too.
+func TestWatchReplayDoesNotDeadlock(t *testing.T) {
+	s := &KvStore{
+		kvStore:  make(map[string]string),
+		watchers: make(map[*watcher]struct{}),
+	}
+	for i := 0; i < watchRingSize; i++ {
+		s.watchRing = append(s.watchRing, Event{Revision: uint64(i), Key: fmt.Sprintf("/foo/%d", i), Op: "PUT"})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ch, cancel := s.Watch("/foo/", 0)
+		defer cancel()
+		_ = ch
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch did not return; replay is blocking while holding the store lock")
+	}
+
+	if _, ok := s.Lookup("anything"); ok {
+		t.Fatal("unexpected key present")
+	}
+}
+
+// TestWatchReplayPrecedesConcurrentPublish guards against a race where a
+// watcher observes a live event out of order relative to the replay it
+// should have caught up on first: registering the watcher and delivering
+// the replay must happen under the same lock publish uses, so publish can't
+// interleave a new event between the two.
+func TestWatchReplayPrecedesConcurrentPublish(t *testing.T) {
+	s := &KvStore{
+		kvStore:  make(map[string]string),
+		watchers: make(map[*watcher]struct{}),
+	}
+	for i := 0; i < 8; i++ {
+		s.mu.Lock()
+		s.publish(Event{Revision: uint64(i), Key: "/foo/a", Op: "PUT"})
+		s.mu.Unlock()
+	}
+
+	published := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		s.publish(Event{Revision: 8, Key: "/foo/a", Op: "PUT"})
+		s.mu.Unlock()
+		close(published)
+	}()
+
+	ch, cancel := s.Watch("/foo/", 0)
+	defer cancel()
+	<-published
+
+	var got []uint64
+	for i := 0; i < 9; i++ {
+		select {
+		case ev := <-ch:
+			got = append(got, ev.Revision)
+		case <-time.After(time.Second):
+			t.Fatalf("only received %d of 9 events", len(got))
+		}
+	}
+	for i, rev := range got {
+		if rev != uint64(i) {
+			t.Fatalf("events out of order: got %v, want revisions 0..8 in order", got)
+		}
+	}
+}